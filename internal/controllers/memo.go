@@ -0,0 +1,38 @@
+package controllers
+
+import "sync"
+
+// memo memoizes the result of compute per key, running compute at most
+// once per key regardless of how many goroutines call get concurrently.
+// It has no eviction: callers are expected to create a fresh memo for
+// the scope they want memoized (for example, a single Reconcile call).
+type memo[K comparable, V any] struct {
+	mu      sync.Mutex
+	entries map[K]*memoEntry[V]
+}
+
+type memoEntry[V any] struct {
+	once sync.Once
+	val  V
+	err  error
+}
+
+func newMemo[K comparable, V any]() *memo[K, V] {
+	return &memo[K, V]{entries: make(map[K]*memoEntry[V])}
+}
+
+func (m *memo[K, V]) get(key K, compute func() (V, error)) (V, error) {
+	m.mu.Lock()
+	entry, ok := m.entries[key]
+	if !ok {
+		entry = &memoEntry[V]{}
+		m.entries[key] = entry
+	}
+	m.mu.Unlock()
+
+	entry.once.Do(func() {
+		entry.val, entry.err = compute()
+	})
+
+	return entry.val, entry.err
+}
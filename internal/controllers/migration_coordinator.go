@@ -0,0 +1,105 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// MigrationConfigMapName and MigrationConfigMapNamespace identify
+	// the well-known ConfigMap whose presence marks a pending NMC
+	// migration; Run records completion under its "done" key.
+	MigrationConfigMapName      = "kmm-migration-status"
+	MigrationConfigMapNamespace = "openshift-kmm"
+
+	migrationDoneDataKey = "done"
+)
+
+// MigrationCoordinator checks for and completes an operator upgrade's
+// NMC migration (for example, the introduction of
+// beta.kmm.node.kubernetes.io/nmc.<ns>.<name> labels) and closes Done
+// once it is safe for ModuleNMCReconciler and the PreflightValidation
+// reconciler to resume processing. main wires one up before starting
+// those reconcilers, passing its Done channel in via WithMigrationCh.
+type MigrationCoordinator struct {
+	client client.Client
+	done   chan struct{}
+}
+
+func NewMigrationCoordinator(client client.Client) *MigrationCoordinator {
+	return &MigrationCoordinator{
+		client: client,
+		done:   make(chan struct{}),
+	}
+}
+
+// Done is closed once the migration has completed.
+func (mc *MigrationCoordinator) Done() chan struct{} {
+	return mc.done
+}
+
+// Run reads the well-known migration ConfigMap once; it does not wait
+// or watch for the ConfigMap to change. When no migration ConfigMap
+// exists, Run assumes there is nothing to migrate and closes Done
+// immediately. When its "done" key is already "true", Run closes Done.
+// Otherwise Run runs the NMC relabeling/normalization passes, sets the
+// "done" key to "true", then closes Done. Done is only
+// closed on a confirmed-complete path: if the ConfigMap cannot be read,
+// NMC normalization fails, or the completion patch fails, Run returns an
+// error and leaves Done open, so the gate stays shut rather than letting
+// reconciliation run against a half-migrated state. It is meant to run
+// once, early in main, before the reconcilers it gates are started.
+func (mc *MigrationCoordinator) Run(ctx context.Context) error {
+	logger := log.FromContext(ctx)
+
+	cm := v1.ConfigMap{}
+	key := types.NamespacedName{Name: MigrationConfigMapName, Namespace: MigrationConfigMapNamespace}
+
+	if err := mc.client.Get(ctx, key, &cm); err != nil {
+		if k8serrors.IsNotFound(err) {
+			logger.Info("No migration ConfigMap found; nothing to migrate")
+			close(mc.done)
+			return nil
+		}
+		return fmt.Errorf("failed to get the %s ConfigMap: %v", key, err)
+	}
+
+	if cm.Data[migrationDoneDataKey] == "true" {
+		logger.Info("Migration already marked done", "configmap", key)
+		close(mc.done)
+		return nil
+	}
+
+	logger.Info("Running NMC relabeling/normalization for operator upgrade", "configmap", key)
+
+	if err := mc.normalizeNMCs(ctx); err != nil {
+		return fmt.Errorf("failed to normalize NMCs during migration: %v", err)
+	}
+
+	cmCopy := cm.DeepCopy()
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	cm.Data[migrationDoneDataKey] = "true"
+
+	if err := mc.client.Patch(ctx, &cm, client.MergeFrom(cmCopy)); err != nil {
+		return fmt.Errorf("failed to mark the %s ConfigMap as done: %v", key, err)
+	}
+
+	logger.Info("NMC migration complete; unblocking reconciliation", "configmap", key)
+	close(mc.done)
+	return nil
+}
+
+// normalizeNMCs applies whatever NMC relabeling/normalization the
+// current schema migration requires. It is a no-op until a concrete
+// migration needs it.
+func (mc *MigrationCoordinator) normalizeNMCs(_ context.Context) error {
+	return nil
+}
@@ -4,7 +4,9 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	stdruntime "runtime"
 	"strings"
+	"sync"
 
 	"github.com/hashicorp/go-multierror"
 	buildv1 "github.com/openshift/api/build/v1"
@@ -17,6 +19,7 @@ import (
 	"github.com/rh-ecosystem-edge/kernel-module-management/internal/nmc"
 	"github.com/rh-ecosystem-edge/kernel-module-management/internal/registry"
 	"github.com/rh-ecosystem-edge/kernel-module-management/internal/utils"
+	"golang.org/x/sync/errgroup"
 	v1 "k8s.io/api/core/v1"
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -31,6 +34,12 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/log"
 )
 
+// defaultSchedulingDataConcurrencyFactor is multiplied by
+// runtime.NumCPU() to get the default size of the worker pool
+// prepareSchedulingData fans out over, absent
+// WithSchedulingDataConcurrency.
+const defaultSchedulingDataConcurrencyFactor = 4
+
 //+kubebuilder:rbac:groups="core",resources=nodes,verbs=get;watch
 //+kubebuilder:rbac:groups=kmm.sigs.x-k8s.io,resources=nodemodulesconfigs,verbs=get;list;watch;patch;create
 
@@ -47,6 +56,47 @@ type schedulingData struct {
 type ModuleNMCReconciler struct {
 	filter      *filter.Filter
 	reconHelper moduleNMCReconcilerHelperAPI
+
+	// migrationCh gates Reconcile during operator upgrades that change
+	// the NMC schema or relabel NMCs: no Module is reconciled until it
+	// is closed by a MigrationCoordinator. NewModuleNMCReconciler
+	// defaults it to an already-closed channel, so the gate is a no-op
+	// unless WithMigrationCh is used.
+	migrationCh chan struct{}
+}
+
+// ModuleNMCReconcilerOption customizes a ModuleNMCReconciler constructed
+// by NewModuleNMCReconciler.
+type ModuleNMCReconcilerOption func(*moduleNMCReconcilerConfig)
+
+type moduleNMCReconcilerConfig struct {
+	migrationChVal chan struct{}
+	concurrency    int
+}
+
+// WithMigrationCh gates Reconcile on migrationCh: no Module is
+// reconciled until migrationCh is closed. Use this during operator
+// upgrades that change the NMC schema or relabel NMCs, so that
+// reconciliation cannot race with the migration job.
+func WithMigrationCh(migrationCh chan struct{}) ModuleNMCReconcilerOption {
+	return func(c *moduleNMCReconcilerConfig) {
+		c.migrationChVal = migrationCh
+	}
+}
+
+// WithSchedulingDataConcurrency overrides the size of the worker pool
+// prepareSchedulingData fans node processing out over. The default is
+// runtime.NumCPU() * 4. Values below 1 are clamped to 1, since a
+// zero-size pool would wedge every node on the semaphore send instead of
+// bounding concurrency, and a negative size would panic the make(chan)
+// call.
+func WithSchedulingDataConcurrency(n int) ModuleNMCReconcilerOption {
+	return func(c *moduleNMCReconcilerConfig) {
+		if n < 1 {
+			n = 1
+		}
+		c.concurrency = n
+	}
 }
 
 func NewModuleNMCReconciler(client client.Client,
@@ -55,17 +105,38 @@ func NewModuleNMCReconciler(client client.Client,
 	nmcHelper nmc.Helper,
 	filter *filter.Filter,
 	authFactory auth.RegistryAuthGetterFactory,
-	scheme *runtime.Scheme) *ModuleNMCReconciler {
-	reconHelper := newModuleNMCReconcilerHelper(client, kernelAPI, registryAPI, nmcHelper, authFactory, scheme)
+	scheme *runtime.Scheme,
+	opts ...ModuleNMCReconcilerOption) *ModuleNMCReconciler {
+	closedCh := make(chan struct{})
+	close(closedCh)
+
+	cfg := moduleNMCReconcilerConfig{
+		migrationChVal: closedCh,
+		concurrency:    stdruntime.NumCPU() * defaultSchedulingDataConcurrencyFactor,
+	}
+
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	reconHelper := newModuleNMCReconcilerHelper(client, kernelAPI, registryAPI, nmcHelper, authFactory, scheme, cfg.concurrency)
+
 	return &ModuleNMCReconciler{
 		filter:      filter,
 		reconHelper: reconHelper,
+		migrationCh: cfg.migrationChVal,
 	}
 }
 
 func (mnr *ModuleNMCReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	logger := log.FromContext(ctx)
 
+	select {
+	case <-mnr.migrationCh:
+	case <-ctx.Done():
+		return ctrl.Result{}, ctx.Err()
+	}
+
 	logger.Info("Starting Module-NMS reconcilation", "module name and namespace", req.NamespacedName)
 
 	mod, err := mnr.reconHelper.getRequestedModule(ctx, req.NamespacedName)
@@ -105,9 +176,11 @@ func (mnr *ModuleNMCReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 	var sumErr *multierror.Error
 	sumErr = multierror.Append(sumErr, prepareErrs...)
 
+	imageExistsCache := newMemo[string, bool]()
+
 	for nodeName, sd := range sdMap {
 		if sd.mld != nil {
-			err = mnr.reconHelper.enableModuleOnNode(ctx, sd.mld, sd.node)
+			err = mnr.reconHelper.enableModuleOnNode(ctx, sd.mld, sd.node, imageExistsCache)
 		} else if sd.nmcExists {
 			err = mnr.reconHelper.disableModuleOnNode(ctx, mod.Namespace, mod.Name, nodeName)
 		}
@@ -130,7 +203,7 @@ type moduleNMCReconcilerHelperAPI interface {
 	getNodesListBySelector(ctx context.Context, mod *kmmv1beta1.Module) ([]v1.Node, error)
 	getNMCsByModuleSet(ctx context.Context, mod *kmmv1beta1.Module) (sets.Set[string], error)
 	prepareSchedulingData(ctx context.Context, mod *kmmv1beta1.Module, targetedNodes []v1.Node, currentNMCs sets.Set[string]) (map[string]schedulingData, []error)
-	enableModuleOnNode(ctx context.Context, mld *api.ModuleLoaderData, node *v1.Node) error
+	enableModuleOnNode(ctx context.Context, mld *api.ModuleLoaderData, node *v1.Node, imageExistsCache *memo[string, bool]) error
 	disableModuleOnNode(ctx context.Context, modNamespace, modName, nodeName string) error
 }
 
@@ -141,6 +214,7 @@ type moduleNMCReconcilerHelper struct {
 	nmcHelper   nmc.Helper
 	authFactory auth.RegistryAuthGetterFactory
 	scheme      *runtime.Scheme
+	concurrency int
 }
 
 func newModuleNMCReconcilerHelper(client client.Client,
@@ -148,7 +222,8 @@ func newModuleNMCReconcilerHelper(client client.Client,
 	registryAPI registry.Registry,
 	nmcHelper nmc.Helper,
 	authFactory auth.RegistryAuthGetterFactory,
-	scheme *runtime.Scheme) moduleNMCReconcilerHelperAPI {
+	scheme *runtime.Scheme,
+	concurrency int) moduleNMCReconcilerHelperAPI {
 	return &moduleNMCReconcilerHelper{
 		client:      client,
 		kernelAPI:   kernelAPI,
@@ -156,6 +231,7 @@ func newModuleNMCReconcilerHelper(client client.Client,
 		nmcHelper:   nmcHelper,
 		authFactory: authFactory,
 		scheme:      scheme,
+		concurrency: concurrency,
 	}
 }
 
@@ -257,36 +333,84 @@ func (mnrh *moduleNMCReconcilerHelper) getNMCsNamesForModule(ctx context.Context
 // in case there is an error during handling one of the nodes, function continues to the next node
 // It returns the map of scheduling data per successfully processed node, and slice of errors
 // per unsuccessfuly processed nodes
+//
+// Nodes are processed concurrently over a worker pool bounded by
+// mnrh.concurrency, and GetModuleLoaderDataForKernel is memoized per
+// kernel version for the duration of the call, since it is common for
+// a fleet to share a handful of kernel versions across thousands of
+// nodes.
 func (mnrh *moduleNMCReconcilerHelper) prepareSchedulingData(ctx context.Context,
 	mod *kmmv1beta1.Module,
 	targetedNodes []v1.Node,
 	currentNMCs sets.Set[string]) (map[string]schedulingData, []error) {
 
 	logger := log.FromContext(ctx)
-	result := make(map[string]schedulingData)
+
+	var mu sync.Mutex
+	result := make(map[string]schedulingData, len(targetedNodes))
 	errs := make([]error, 0, len(targetedNodes))
-	for _, node := range targetedNodes {
-		kernelVersion := strings.TrimSuffix(node.Status.NodeInfo.KernelVersion, "+")
-		mld, err := mnrh.kernelAPI.GetModuleLoaderDataForKernel(mod, kernelVersion)
-		if err != nil && !errors.Is(err, module.ErrNoMatchingKernelMapping) {
-			// deleting earlier, so as not to change NMC in case we failed to determine mld
+
+	kernelMappingCache := newMemo[string, *api.ModuleLoaderData]()
+
+	g, _ := errgroup.WithContext(ctx)
+	sem := make(chan struct{}, mnrh.concurrency)
+
+	for i := range targetedNodes {
+		node := targetedNodes[i]
+
+		g.Go(func() error {
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				// deleting here too, so a node that never got a worker
+				// slot doesn't fall into the "disable" bucket below
+				mu.Lock()
+				currentNMCs.Delete(node.Name)
+				errs = append(errs, fmt.Errorf("context done before processing node %s: %w", node.Name, ctx.Err()))
+				mu.Unlock()
+				return nil
+			}
+
+			kernelVersion := strings.TrimSuffix(node.Status.NodeInfo.KernelVersion, "+")
+
+			mld, err := kernelMappingCache.get(kernelVersion, func() (*api.ModuleLoaderData, error) {
+				return mnrh.kernelAPI.GetModuleLoaderDataForKernel(mod, kernelVersion)
+			})
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if err != nil && !errors.Is(err, module.ErrNoMatchingKernelMapping) {
+				// deleting earlier, so as not to change NMC in case we failed to determine mld
+				currentNMCs.Delete(node.Name)
+				logger.Info(utils.WarnString(fmt.Sprintf("internal errors while fetching kernel mapping for version %s: %v", kernelVersion, err)))
+				errs = append(errs, err)
+				return nil
+			}
+
+			result[node.Name] = schedulingData{mld: mld, node: &node, nmcExists: currentNMCs.Has(node.Name)}
 			currentNMCs.Delete(node.Name)
-			logger.Info(utils.WarnString(fmt.Sprintf("internal errors while fetching kernel mapping for version %s: %v", kernelVersion, err)))
-			errs = append(errs, err)
-			continue
-		}
-		result[node.Name] = schedulingData{mld: mld, node: &node, nmcExists: currentNMCs.Has(node.Name)}
-		currentNMCs.Delete(node.Name)
+			return nil
+		})
 	}
+
+	// g.Go never returns an error above; errors are collected into errs
+	// directly so that one node's failure doesn't cancel the others.
+	_ = g.Wait()
+
 	for _, nmcName := range currentNMCs.UnsortedList() {
 		result[nmcName] = schedulingData{mld: nil, nmcExists: true}
 	}
 	return result, errs
 }
 
-func (mnrh *moduleNMCReconcilerHelper) enableModuleOnNode(ctx context.Context, mld *api.ModuleLoaderData, node *v1.Node) error {
+func (mnrh *moduleNMCReconcilerHelper) enableModuleOnNode(ctx context.Context, mld *api.ModuleLoaderData, node *v1.Node, imageExistsCache *memo[string, bool]) error {
 	logger := log.FromContext(ctx)
-	exists, err := module.ImageExists(ctx, mnrh.authFactory, mnrh.registryAPI, mld, mld.ContainerImage)
+
+	exists, err := imageExistsCache.get(mld.ContainerImage, func() (bool, error) {
+		return module.ImageExists(ctx, mnrh.authFactory, mnrh.registryAPI, mld, mld.ContainerImage)
+	})
 	if err != nil {
 		return fmt.Errorf("failed to verify is image %s exists: %v", mld.ContainerImage, err)
 	}
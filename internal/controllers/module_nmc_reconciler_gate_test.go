@@ -0,0 +1,117 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	kmmv1beta1 "github.com/rh-ecosystem-edge/kernel-module-management/api/v1beta1"
+	"github.com/rh-ecosystem-edge/kernel-module-management/internal/api"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// stubReconcilerHelper is a no-op moduleNMCReconcilerHelperAPI that lets the
+// gate test run Reconcile past the migrationCh check without a fake client
+// and the rest of Reconcile's dependencies wired up: every method returns an
+// empty, non-error result, so Reconcile runs its full body and returns
+// cleanly once it clears the gate.
+type stubReconcilerHelper struct{}
+
+func (stubReconcilerHelper) setFinalizer(ctx context.Context, mod *kmmv1beta1.Module) error {
+	return nil
+}
+
+func (stubReconcilerHelper) finalizeModule(ctx context.Context, mod *kmmv1beta1.Module) error {
+	return nil
+}
+
+func (stubReconcilerHelper) getRequestedModule(ctx context.Context, namespacedName types.NamespacedName) (*kmmv1beta1.Module, error) {
+	return &kmmv1beta1.Module{}, nil
+}
+
+func (stubReconcilerHelper) getNodesListBySelector(ctx context.Context, mod *kmmv1beta1.Module) ([]v1.Node, error) {
+	return nil, nil
+}
+
+func (stubReconcilerHelper) getNMCsByModuleSet(ctx context.Context, mod *kmmv1beta1.Module) (sets.Set[string], error) {
+	return nil, nil
+}
+
+func (stubReconcilerHelper) prepareSchedulingData(ctx context.Context, mod *kmmv1beta1.Module, targetedNodes []v1.Node, currentNMCs sets.Set[string]) (map[string]schedulingData, []error) {
+	return nil, nil
+}
+
+func (stubReconcilerHelper) enableModuleOnNode(ctx context.Context, mld *api.ModuleLoaderData, node *v1.Node, imageExistsCache *memo[string, bool]) error {
+	return nil
+}
+
+func (stubReconcilerHelper) disableModuleOnNode(ctx context.Context, modNamespace, modName, nodeName string) error {
+	return nil
+}
+
+// gateOnlyReconciler exercises just the migrationCh gate at the top of
+// Reconcile. reconHelper is a stub so the post-gate path returns cleanly
+// instead of panicking on a nil interface.
+func gateOnlyReconciler(migrationCh chan struct{}) *ModuleNMCReconciler {
+	return &ModuleNMCReconciler{migrationCh: migrationCh, reconHelper: stubReconcilerHelper{}}
+}
+
+func TestReconcile_BlocksUntilmigrationChClosed(t *testing.T) {
+	migrationCh := make(chan struct{})
+	mnr := gateOnlyReconciler(migrationCh)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// reconHelper is a no-op stub: if the gate did not block, the call
+		// below would return almost at once instead of blocking here, and
+		// the first select below would fail this test.
+		_, _ = mnr.Reconcile(context.Background(), ctrl.Request{})
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("Reconcile returned before migrationCh was closed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(migrationCh)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Reconcile did not unblock after migrationCh was closed")
+	}
+}
+
+func TestReconcile_UnblocksOnContextCancellation(t *testing.T) {
+	mnr := gateOnlyReconciler(make(chan struct{})) // never closed
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan error)
+	go func() {
+		_, err := mnr.Reconcile(ctx, ctrl.Request{})
+		done <- err
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("Reconcile returned before the context was cancelled")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cancel()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expected Reconcile to return the context's error")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Reconcile did not unblock after the context was cancelled")
+	}
+}
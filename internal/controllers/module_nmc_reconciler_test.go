@@ -0,0 +1,154 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	kmmv1beta1 "github.com/rh-ecosystem-edge/kernel-module-management/api/v1beta1"
+	"github.com/rh-ecosystem-edge/kernel-module-management/internal/api"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// fakeKernelMapper counts how many times GetModuleLoaderDataForKernel is
+// called per kernel version, so tests can assert on memoization.
+type fakeKernelMapper struct {
+	callsByVersion map[string]*int32
+}
+
+func newFakeKernelMapper(versions ...string) *fakeKernelMapper {
+	callsByVersion := make(map[string]*int32, len(versions))
+	for _, v := range versions {
+		var n int32
+		callsByVersion[v] = &n
+	}
+	return &fakeKernelMapper{callsByVersion: callsByVersion}
+}
+
+func (f *fakeKernelMapper) GetModuleLoaderDataForKernel(mod *kmmv1beta1.Module, kernelVersion string) (*api.ModuleLoaderData, error) {
+	counter, ok := f.callsByVersion[kernelVersion]
+	if !ok {
+		var n int32
+		counter = &n
+		f.callsByVersion[kernelVersion] = counter
+	}
+	atomic.AddInt32(counter, 1)
+
+	return &api.ModuleLoaderData{KernelVersion: kernelVersion}, nil
+}
+
+func (f *fakeKernelMapper) callCount(kernelVersion string) int32 {
+	counter, ok := f.callsByVersion[kernelVersion]
+	if !ok {
+		return 0
+	}
+	return atomic.LoadInt32(counter)
+}
+
+func nodesWithKernelVersions(versions []string, countPerVersion int) []v1.Node {
+	nodes := make([]v1.Node, 0, len(versions)*countPerVersion)
+	for _, version := range versions {
+		for i := 0; i < countPerVersion; i++ {
+			node := v1.Node{}
+			node.Name = fmt.Sprintf("node-%s-%d", version, i)
+			node.Status.NodeInfo.KernelVersion = version
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+func TestPrepareSchedulingData_MemoizesPerKernelVersion(t *testing.T) {
+	versions := []string{"5.14.0-1", "5.14.0-2", "5.14.0-3"}
+	nodes := nodesWithKernelVersions(versions, 50)
+
+	kernelAPI := newFakeKernelMapper(versions...)
+	mnrh := &moduleNMCReconcilerHelper{kernelAPI: kernelAPI, concurrency: 8}
+
+	result, errs := mnrh.prepareSchedulingData(context.Background(), &kmmv1beta1.Module{}, nodes, sets.New[string]())
+	if len(errs) != 0 {
+		t.Fatalf("prepareSchedulingData returned errors: %v", errs)
+	}
+	if len(result) != len(nodes) {
+		t.Fatalf("got %d scheduling data entries, want %d", len(result), len(nodes))
+	}
+
+	for _, version := range versions {
+		if got := kernelAPI.callCount(version); got != 1 {
+			t.Errorf("GetModuleLoaderDataForKernel(%q) called %d times, want 1 (should be memoized across nodes)", version, got)
+		}
+	}
+}
+
+func TestWithSchedulingDataConcurrency_ClampsBelowOneToOne(t *testing.T) {
+	cases := []int{-1, 0, 1, 8}
+
+	for _, n := range cases {
+		cfg := moduleNMCReconcilerConfig{}
+		WithSchedulingDataConcurrency(n)(&cfg)
+
+		want := n
+		if want < 1 {
+			want = 1
+		}
+
+		if cfg.concurrency != want {
+			t.Errorf("WithSchedulingDataConcurrency(%d) set concurrency to %d, want %d", n, cfg.concurrency, want)
+		}
+	}
+}
+
+func TestPrepareSchedulingData_ContextCancellationDoesNotDisableModule(t *testing.T) {
+	nodes := nodesWithKernelVersions([]string{"5.14.0-1"}, 5)
+
+	kernelAPI := newFakeKernelMapper()
+	// concurrency 0 means the semaphore channel is unbuffered and never
+	// drained, so every goroutine's select is forced onto the ctx.Done()
+	// branch once ctx is already cancelled.
+	mnrh := &moduleNMCReconcilerHelper{kernelAPI: kernelAPI, concurrency: 0}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	currentNMCs := sets.New[string]()
+	for _, node := range nodes {
+		currentNMCs.Insert(node.Name)
+	}
+
+	result, errs := mnrh.prepareSchedulingData(ctx, &kmmv1beta1.Module{}, nodes, currentNMCs)
+
+	if len(errs) != len(nodes) {
+		t.Fatalf("got %d errors, want one per cancelled node (%d)", len(errs), len(nodes))
+	}
+
+	for _, node := range nodes {
+		if sd, ok := result[node.Name]; ok {
+			t.Errorf("node %s was cancelled mid-flight but still appears in the result as %+v; it must not be treated as a disable candidate", node.Name, sd)
+		}
+	}
+}
+
+// BenchmarkPrepareSchedulingData_5000Nodes20Kernels exercises the fan-out
+// worker pool with a synthetic fleet of 5000 nodes spanning 20 distinct
+// kernel versions, the scale the concurrency redesign targets.
+func BenchmarkPrepareSchedulingData_5000Nodes20Kernels(b *testing.B) {
+	versions := make([]string, 20)
+	for i := range versions {
+		versions[i] = fmt.Sprintf("5.14.0-%d", i)
+	}
+	nodes := nodesWithKernelVersions(versions, 250) // 20 * 250 = 5000 nodes
+
+	mod := &kmmv1beta1.Module{}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		kernelAPI := newFakeKernelMapper(versions...)
+		mnrh := &moduleNMCReconcilerHelper{kernelAPI: kernelAPI, concurrency: 64}
+
+		if _, errs := mnrh.prepareSchedulingData(context.Background(), mod, nodes, sets.New[string]()); len(errs) != 0 {
+			b.Fatalf("prepareSchedulingData returned errors: %v", errs)
+		}
+	}
+}
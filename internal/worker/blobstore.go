@@ -0,0 +1,470 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/pkg/idtools"
+	"github.com/go-logr/logr"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/moby/moby/pkg/archive"
+)
+
+const (
+	whiteoutPrefix    = ".wh."
+	whiteoutOpaqueDir = ".wh..wh..opq"
+
+	manifestRefsFileName = "manifest-refs.json"
+)
+
+// layerBlobStore is a content-addressable cache of extracted image
+// layers, keyed by layer digest, shared by every image mounted by this
+// worker. Image roots are assembled on top of it by hardlinking cached
+// layer files into a per-image directory, so that images sharing a
+// common base only ever pull and extract that base once.
+type layerBlobStore struct {
+	baseDir    string
+	gcInterval time.Duration
+	logger     logr.Logger
+
+	mu sync.Mutex // guards manifest-refs.json reads/writes
+
+	extractLocks sync.Map // digest string -> *sync.Mutex; serializes concurrent ensureLayer calls for the same digest
+
+	pinsMu sync.Mutex
+	pins   map[string]int // digest string -> number of in-flight users; gc skips pinned digests
+}
+
+func newLayerBlobStore(baseDir string, gcInterval time.Duration, logger logr.Logger) *layerBlobStore {
+	return &layerBlobStore{
+		baseDir:    baseDir,
+		gcInterval: gcInterval,
+		logger:     logger,
+		pins:       make(map[string]int),
+	}
+}
+
+// pin marks digest as in-flight-use so that a concurrently running gc
+// will not remove it even if no manifest references it yet. The
+// returned func must be called once the caller no longer needs digest
+// (typically once recordManifestLayers has been called for the image
+// using it).
+func (s *layerBlobStore) pin(digest string) func() {
+	s.pinsMu.Lock()
+	s.pins[digest]++
+	s.pinsMu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.pinsMu.Lock()
+			s.pins[digest]--
+			if s.pins[digest] <= 0 {
+				delete(s.pins, digest)
+			}
+			s.pinsMu.Unlock()
+		})
+	}
+}
+
+func (s *layerBlobStore) isPinned(digest string) bool {
+	s.pinsMu.Lock()
+	defer s.pinsMu.Unlock()
+
+	return s.pins[digest] > 0
+}
+
+func (s *layerBlobStore) blobsDir() string {
+	return filepath.Join(s.baseDir, "blobs")
+}
+
+func (s *layerBlobStore) blobDir(digest v1.Hash) string {
+	return filepath.Join(s.blobsDir(), digest.Algorithm, digest.Hex)
+}
+
+// ensureLayer makes sure layer is extracted into the blob store and
+// returns the path to its cached, extracted contents. Concurrent calls
+// for the same digest are serialized, so that two images sharing a base
+// layer never extract it into the same temp directory at once.
+func (s *layerBlobStore) ensureLayer(layer v1.Layer) (string, error) {
+	digest, err := layer.Digest()
+	if err != nil {
+		return "", fmt.Errorf("could not get the layer digest: %v", err)
+	}
+
+	digestStr := digest.String()
+
+	muIface, _ := s.extractLocks.LoadOrStore(digestStr, &sync.Mutex{})
+	extractLock := muIface.(*sync.Mutex)
+	extractLock.Lock()
+	defer extractLock.Unlock()
+
+	blobDir := s.blobDir(digest)
+
+	if _, err := os.Stat(blobDir); err == nil {
+		s.logger.V(1).Info("Layer already cached", "digest", digestStr)
+		return blobDir, nil
+	} else if !os.IsNotExist(err) {
+		return "", fmt.Errorf("could not stat the blob directory %s: %v", blobDir, err)
+	}
+
+	tmpDir := blobDir + ".tmp"
+
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return "", fmt.Errorf("could not clean up the stale temp directory %s: %v", tmpDir, err)
+	}
+
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return "", fmt.Errorf("could not create the temp directory %s: %v", tmpDir, err)
+	}
+
+	rc, err := layer.Uncompressed()
+	if err != nil {
+		return "", fmt.Errorf("could not read layer %s: %v", digest, err)
+	}
+	defer rc.Close()
+
+	id := idtools.CurrentIdentity()
+	tarOpts := &archive.TarOptions{ChownOpts: &id}
+
+	if err := archive.Untar(rc, tmpDir, tarOpts); err != nil {
+		return "", fmt.Errorf("could not extract layer %s: %v", digest, err)
+	}
+
+	if err := os.Rename(tmpDir, blobDir); err != nil {
+		return "", fmt.Errorf("could not publish layer %s to the blob store: %v", digest, err)
+	}
+
+	s.logger.V(1).Info("Cached layer", "digest", digest.String())
+
+	return blobDir, nil
+}
+
+// assembleRoot stacks layerDirs, in order, into dstDirFS by hardlinking
+// (falling back to copying across devices) their files, applying OCI
+// whiteouts along the way.
+func (s *layerBlobStore) assembleRoot(dstDirFS string, layerDirs []string) error {
+	if err := os.MkdirAll(dstDirFS, 0755); err != nil {
+		return fmt.Errorf("could not create the filesystem directory %s: %v", dstDirFS, err)
+	}
+
+	for _, layerDir := range layerDirs {
+		if err := applyLayer(layerDir, dstDirFS); err != nil {
+			return fmt.Errorf("could not apply layer from %s: %v", layerDir, err)
+		}
+	}
+
+	return nil
+}
+
+func applyLayer(layerDir, dstDirFS string) error {
+	return filepath.Walk(layerDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if path == layerDir {
+			return nil
+		}
+
+		rel, err := filepath.Rel(layerDir, path)
+		if err != nil {
+			return err
+		}
+
+		base := filepath.Base(rel)
+		dir := filepath.Dir(rel)
+
+		if base == whiteoutOpaqueDir {
+			return clearDir(filepath.Join(dstDirFS, dir))
+		}
+
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			target := filepath.Join(dstDirFS, dir, strings.TrimPrefix(base, whiteoutPrefix))
+			if err := os.RemoveAll(target); err != nil {
+				return fmt.Errorf("could not apply whiteout for %s: %v", target, err)
+			}
+			return nil
+		}
+
+		dst := filepath.Join(dstDirFS, rel)
+
+		if info.IsDir() {
+			return os.MkdirAll(dst, info.Mode())
+		}
+
+		if err := os.RemoveAll(dst); err != nil {
+			return err
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, dst)
+		}
+
+		if err := os.Link(path, dst); err != nil {
+			return copyFile(path, dst, info.Mode())
+		}
+
+		return nil
+	})
+}
+
+func clearDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	return err
+}
+
+// recordManifestLayers remembers which layer digests back manifestDigest,
+// so that a future gc knows which blobs are still referenced.
+func (s *layerBlobStore) recordManifestLayers(manifestDigest string, layerDigests []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	refs, err := s.loadManifestRefs()
+	if err != nil {
+		return err
+	}
+
+	refs[manifestDigest] = layerDigests
+
+	return s.saveManifestRefs(refs)
+}
+
+func (s *layerBlobStore) manifestRefsPath() string {
+	return filepath.Join(s.blobsDir(), manifestRefsFileName)
+}
+
+func (s *layerBlobStore) loadManifestRefs() (map[string][]string, error) {
+	refs := make(map[string][]string)
+
+	b, err := os.ReadFile(s.manifestRefsPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return refs, nil
+		}
+		return nil, fmt.Errorf("could not read the manifest references file: %v", err)
+	}
+
+	if err := json.Unmarshal(b, &refs); err != nil {
+		return nil, fmt.Errorf("could not parse the manifest references file: %v", err)
+	}
+
+	return refs, nil
+}
+
+func (s *layerBlobStore) saveManifestRefs(refs map[string][]string) error {
+	if err := os.MkdirAll(s.blobsDir(), 0755); err != nil {
+		return fmt.Errorf("could not create the blobs directory: %v", err)
+	}
+
+	b, err := json.Marshal(refs)
+	if err != nil {
+		return fmt.Errorf("could not serialize the manifest references file: %v", err)
+	}
+
+	if err := os.WriteFile(s.manifestRefsPath(), b, 0644); err != nil {
+		return fmt.Errorf("could not write the manifest references file: %v", err)
+	}
+
+	return nil
+}
+
+// imagesDir is the root under which every mounted image's "digest" file
+// lives; liveManifestDigests walks it to find which manifest digests are
+// currently in use by a cached image.
+func (s *layerBlobStore) imagesDir() string {
+	return filepath.Join(s.baseDir, "images")
+}
+
+// liveManifestDigests returns the set of manifest digests currently
+// recorded as a cached image's digest file, i.e. the manifests actually
+// in use right now, as opposed to every manifest ever pulled.
+func (s *layerBlobStore) liveManifestDigests() (map[string]struct{}, error) {
+	live := make(map[string]struct{})
+
+	err := filepath.Walk(s.imagesDir(), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() || info.Name() != "digest" {
+			return nil
+		}
+
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("could not read the digest file %s: %v", path, err)
+		}
+
+		live[string(b)] = struct{}{}
+		return nil
+	})
+
+	if err != nil {
+		if os.IsNotExist(err) {
+			return live, nil
+		}
+		return nil, fmt.Errorf("could not scan %s for live image digests: %v", s.imagesDir(), err)
+	}
+
+	return live, nil
+}
+
+// gc removes every cached layer that is no longer referenced by any
+// manifest digest currently in use. Manifest-to-layer mappings recorded
+// for a manifest digest that is no longer live (for example, a tag that
+// has since moved to a different digest) are pruned first, so that a
+// superseded digest does not keep its layers alive forever.
+func (s *layerBlobStore) gc() error {
+	live, err := s.liveManifestDigests()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	refs, err := s.loadManifestRefs()
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+
+	prunedRefs := make(map[string][]string, len(live))
+	for manifestDigest, layerDigests := range refs {
+		if _, ok := live[manifestDigest]; ok {
+			prunedRefs[manifestDigest] = layerDigests
+		}
+	}
+
+	if len(prunedRefs) != len(refs) {
+		if err := s.saveManifestRefs(prunedRefs); err != nil {
+			s.mu.Unlock()
+			return err
+		}
+	}
+	s.mu.Unlock()
+
+	referenced := make(map[string]struct{})
+	for _, layerDigests := range prunedRefs {
+		for _, d := range layerDigests {
+			referenced[d] = struct{}{}
+		}
+	}
+
+	algDirs, err := os.ReadDir(s.blobsDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("could not list the blobs directory: %v", err)
+	}
+
+	removed := 0
+
+	for _, algDir := range algDirs {
+		if !algDir.IsDir() {
+			continue
+		}
+
+		hexDirs, err := os.ReadDir(filepath.Join(s.blobsDir(), algDir.Name()))
+		if err != nil {
+			return fmt.Errorf("could not list the %s blobs: %v", algDir.Name(), err)
+		}
+
+		for _, hexDir := range hexDirs {
+			if strings.HasSuffix(hexDir.Name(), ".tmp") {
+				// An in-progress ensureLayer extraction; it isn't a
+				// published blob yet, so it can't be looked up in
+				// referenced or pins by its real digest. Leave it alone
+				// here and let ensureLayer's own os.RemoveAll(tmpDir)
+				// clean up any stale leftovers on its next run.
+				continue
+			}
+
+			digest := fmt.Sprintf("%s:%s", algDir.Name(), hexDir.Name())
+			if _, ok := referenced[digest]; ok {
+				continue
+			}
+
+			if s.isPinned(digest) {
+				continue
+			}
+
+			path := filepath.Join(s.blobsDir(), algDir.Name(), hexDir.Name())
+			if err := os.RemoveAll(path); err != nil {
+				return fmt.Errorf("could not remove unreferenced blob %s: %v", digest, err)
+			}
+			removed++
+		}
+	}
+
+	if removed > 0 {
+		s.logger.Info("Garbage-collected unreferenced layer blobs", "count", removed)
+	}
+
+	return nil
+}
+
+// startGC runs gc on the configured schedule until ctx is cancelled. It
+// is a no-op when no interval was configured.
+func (s *layerBlobStore) startGC(ctx context.Context) {
+	if s.gcInterval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(s.gcInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := s.gc(); err != nil {
+					s.logger.Error(err, "Could not garbage-collect the layer blob store")
+				}
+			}
+		}
+	}()
+}
@@ -4,28 +4,108 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
-	"sync"
+	"time"
 
-	"github.com/docker/docker/pkg/idtools"
 	"github.com/go-logr/logr"
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/crane"
-	"github.com/moby/moby/pkg/archive"
+	"github.com/google/go-containerregistry/pkg/name"
 	kmmv1beta1 "github.com/rh-ecosystem-edge/kernel-module-management/api/v1beta1"
 	"github.com/rh-ecosystem-edge/kernel-module-management/internal/utils"
 )
 
+// defaultGCInterval is how often the layer blob store is swept for
+// unreferenced blobs when the caller does not configure an interval
+// explicitly via WithGCInterval.
+const defaultGCInterval = time.Hour
+
+// Option configures a remoteImageMounter constructed by
+// NewRemoteImageMounter.
+type Option func(*mounterConfig)
+
+type mounterConfig struct {
+	gcInterval time.Duration
+}
+
+// WithGCInterval overrides how often the shared layer blob store is
+// swept for blobs no longer referenced by any cached image. A zero or
+// negative interval disables garbage collection.
+func WithGCInterval(d time.Duration) Option {
+	return func(c *mounterConfig) {
+		c.gcInterval = d
+	}
+}
+
+// MirrorPullPolicy mirrors the pull-from-mirror semantics used by
+// containers/image's registries.conf: it controls which kind of
+// reference (tag, digest, or both) a mirror entry is allowed to serve.
+type MirrorPullPolicy string
+
+const (
+	MirrorPullPolicyAll        MirrorPullPolicy = "all"
+	MirrorPullPolicyDigestOnly MirrorPullPolicy = "digest-only"
+	MirrorPullPolicyTagOnly    MirrorPullPolicy = "tag-only"
+)
+
+// allows reports whether a mirror governed by this policy may serve the
+// current reference, which is a digest reference when digestRef is true.
+func (p MirrorPullPolicy) allows(digestRef bool) bool {
+	switch p {
+	case MirrorPullPolicyDigestOnly:
+		return digestRef
+	case MirrorPullPolicyTagOnly:
+		return !digestRef
+	default:
+		return true
+	}
+}
+
+// MirrorReference is a single entry in a mirror search order: a rewritten
+// image reference together with the policy that governs which kind of
+// pulls it may serve.
+type MirrorReference struct {
+	Reference string
+	Policy    MirrorPullPolicy
+}
+
+// MirrorSet is the ordered mirror search order configured for an image,
+// together with the unqualified-search-registries fallback to try once
+// every declared mirror has been exhausted.
+type MirrorSet struct {
+	// Primary is the unmirrored, authoritative reference for the image.
+	// It is used to pin a trusted digest before any mirror is consulted
+	// and is not itself subject to mirror pull policy, since it is not
+	// a mirror — it may or may not also appear in Mirrors. If empty,
+	// the image name passed to GetMirrorSet is used.
+	Primary           string
+	Mirrors           []MirrorReference
+	UnqualifiedSearch []string
+}
+
+//go:generate mockgen -source=remoteimagemounter.go -package=worker -destination=mock_remoteimagemounter.go MirrorResolver,remoteImageMounterHelperAPI
+
+type MirrorResolver interface {
+	// GetMirrorSet returns the ordered, policy-annotated mirror set
+	// configured for imageName, along with the unqualified-search
+	// fallback registries to try once every mirror has failed.
+	GetMirrorSet(imageName string) (MirrorSet, error)
+}
+
 type remoteImageMounter struct {
 	logger logr.Logger
 	res    MirrorResolver
 	helper remoteImageMounterHelperAPI
 }
 
-func NewRemoteImageMounter(baseDir string, res MirrorResolver, keyChain authn.Keychain, logger logr.Logger) ImageMounter {
-	helper := newRemoteImageMounterHelper(baseDir, keyChain, logger)
+func NewRemoteImageMounter(baseDir string, res MirrorResolver, keyChain authn.Keychain, logger logr.Logger, opts ...Option) ImageMounter {
+	cfg := mounterConfig{gcInterval: defaultGCInterval}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	helper := newRemoteImageMounterHelper(baseDir, keyChain, cfg.gcInterval, logger)
 	return &remoteImageMounter{
 		logger: logger,
 		res:    res,
@@ -34,61 +114,189 @@ func NewRemoteImageMounter(baseDir string, res MirrorResolver, keyChain authn.Ke
 }
 
 func (rim *remoteImageMounter) MountImage(ctx context.Context, imageName string, cfg *kmmv1beta1.ModuleConfig) (string, error) {
-	imageNames, err := rim.res.GetAllReferences(imageName)
+	mirrorSet, err := rim.res.GetMirrorSet(imageName)
 	if err != nil {
-		return "", fmt.Errorf("could not resolve all mirrored names for %q: %v", imageName, err)
+		return "", fmt.Errorf("could not resolve the mirror set for %q: %v", imageName, err)
 	}
 
-	for _, in := range imageNames {
-		logger := rim.logger.WithValues("image name", in)
+	primary := mirrorSet.Primary
+	if primary == "" {
+		primary = imageName
+	}
+
+	refs := mirrorSet.Mirrors
+	if len(refs) == 0 {
+		refs = []MirrorReference{{Reference: primary, Policy: MirrorPullPolicyAll}}
+	}
+
+	digestRef := isDigestReference(imageName)
+
+	// Pin a digest against the primary source first, so that a
+	// compromised mirror cannot serve a different image under the same
+	// tag later in the loop.
+	expectedDigest := ""
+	trustedDigestPinned := digestRef
+
+	if !digestRef {
+		digest, err := rim.helper.resolveDigest(ctx, primary, cfg)
+		if err != nil {
+			rim.logger.Error(err, "Could not resolve tag to digest against the primary source; refusing to trust mirrors without a pinned digest", "image name", primary)
+		} else {
+			expectedDigest = digest
+			trustedDigestPinned = true
+		}
+	}
+
+	// Without a trusted digest to validate against, we cannot safely
+	// consult less-trusted mirrors or unqualified-search fallbacks: fail
+	// closed and only try the primary source itself.
+	if !trustedDigestPinned {
+		if fsDir, ok := rim.tryReferences(ctx, []MirrorReference{{Reference: primary, Policy: MirrorPullPolicyAll}}, cfg, digestRef, expectedDigest); ok {
+			return fsDir, nil
+		}
+		return "", fmt.Errorf("could not resolve a trusted digest for %q against the primary source %q; refusing to try mirrors", imageName, primary)
+	}
+
+	if fsDir, ok := rim.tryReferences(ctx, refs, cfg, digestRef, expectedDigest); ok {
+		return fsDir, nil
+	}
+
+	for _, registry := range mirrorSet.UnqualifiedSearch {
+		candidate, err := rewriteRegistryHost(imageName, registry)
+		if err != nil {
+			rim.logger.Error(err, "Could not rewrite image name for unqualified-search registry", "registry", registry)
+			continue
+		}
+
+		if fsDir, ok := rim.tryReferences(ctx, []MirrorReference{{Reference: candidate, Policy: MirrorPullPolicyAll}}, cfg, digestRef, expectedDigest); ok {
+			return fsDir, nil
+		}
+	}
+
+	// Every mirror and unqualified-search candidate failed; fall back to
+	// the primary source itself, since it is always a valid pull
+	// candidate even when it is not duplicated into Mirrors.
+	if fsDir, ok := rim.tryReferences(ctx, []MirrorReference{{Reference: primary, Policy: MirrorPullPolicyAll}}, cfg, digestRef, expectedDigest); ok {
+		return fsDir, nil
+	}
+
+	return "", errors.New("all mirrors tried")
+}
+
+func (rim *remoteImageMounter) tryReferences(
+	ctx context.Context,
+	refs []MirrorReference,
+	cfg *kmmv1beta1.ModuleConfig,
+	digestRef bool,
+	expectedDigest string,
+) (string, bool) {
+	for _, mr := range refs {
+		if !mr.Policy.allows(digestRef) {
+			rim.logger.V(1).Info("Skipping mirror disallowed by pull policy", "image name", mr.Reference, "policy", mr.Policy)
+			continue
+		}
+
+		logger := rim.logger.WithValues("image name", mr.Reference)
 		logger.Info("Pulling and mounting image")
 
-		fsDir, err := rim.helper.mountImage(ctx, in, cfg)
+		fsDir, err := rim.helper.mountImage(ctx, mr.Reference, cfg, expectedDigest)
 		if err != nil {
 			logger.Error(err, "Could not pull and mount image")
 			continue
 		}
 
 		logger.Info("Image pulled and mounted successfully", "dir", fsDir)
-		return fsDir, nil
+		return fsDir, true
 	}
 
-	return "", errors.New("all mirrors tried")
+	return "", false
+}
+
+// isDigestReference reports whether imageName refers to an image by
+// digest rather than by tag.
+func isDigestReference(imageName string) bool {
+	ref, err := name.ParseReference(imageName)
+	if err != nil {
+		return false
+	}
+
+	_, ok := ref.(name.Digest)
+	return ok
 }
 
-//go:generate mockgen -source=remoteimagemounter.go -package=worker -destination=mock_remoteimagemounter.go remoteImageMounterHelperAPI
+// rewriteRegistryHost rewrites imageName's registry host to registryHost,
+// preserving the repository path and the tag or digest, the same way
+// containers/image resolves unqualified-search-registries entries.
+func rewriteRegistryHost(imageName, registryHost string) (string, error) {
+	ref, err := name.ParseReference(imageName)
+	if err != nil {
+		return "", fmt.Errorf("could not parse %q: %v", imageName, err)
+	}
+
+	repo := ref.Context().RepositoryStr()
+
+	switch r := ref.(type) {
+	case name.Digest:
+		return fmt.Sprintf("%s/%s@%s", registryHost, repo, r.DigestStr()), nil
+	case name.Tag:
+		return fmt.Sprintf("%s/%s:%s", registryHost, repo, r.TagStr()), nil
+	default:
+		return fmt.Sprintf("%s/%s", registryHost, repo), nil
+	}
+}
 
 type remoteImageMounterHelperAPI interface {
-	mountImage(ctx context.Context, imageName string, cfg *kmmv1beta1.ModuleConfig) (string, error)
+	mountImage(ctx context.Context, imageName string, cfg *kmmv1beta1.ModuleConfig, expectedDigest string) (string, error)
+	resolveDigest(ctx context.Context, imageName string, cfg *kmmv1beta1.ModuleConfig) (string, error)
 }
 
 type remoteImageMounterHelper struct {
-	baseDir  string
-	keyChain authn.Keychain
-	logger   logr.Logger
+	baseDir   string
+	keyChain  authn.Keychain
+	logger    logr.Logger
+	blobStore *layerBlobStore
 }
 
-func newRemoteImageMounterHelper(baseDir string, keyChain authn.Keychain, logger logr.Logger) remoteImageMounterHelperAPI {
+func newRemoteImageMounterHelper(baseDir string, keyChain authn.Keychain, gcInterval time.Duration, logger logr.Logger) remoteImageMounterHelperAPI {
+	blobStore := newLayerBlobStore(baseDir, gcInterval, logger.WithName("blobstore"))
+	blobStore.startGC(context.Background())
+
 	return &remoteImageMounterHelper{
-		baseDir:  baseDir,
-		keyChain: keyChain,
-		logger:   logger,
+		baseDir:   baseDir,
+		keyChain:  keyChain,
+		logger:    logger,
+		blobStore: blobStore,
 	}
 }
 
-func (rimh *remoteImageMounterHelper) mountImage(ctx context.Context, imageName string, cfg *kmmv1beta1.ModuleConfig) (string, error) {
-	logger := rimh.logger.V(1).WithValues("image name", imageName)
-
+func (rimh *remoteImageMounterHelper) craneOptions(ctx context.Context, cfg *kmmv1beta1.ModuleConfig) []crane.Option {
 	opts := []crane.Option{
 		crane.WithContext(ctx),
 		crane.WithAuthFromKeychain(rimh.keyChain),
 	}
 
 	if cfg.InsecurePull {
-		logger.Info(utils.WarnString("Pulling without TLS"))
+		rimh.logger.Info(utils.WarnString("Pulling without TLS"))
 		opts = append(opts, crane.Insecure)
 	}
 
+	return opts
+}
+
+func (rimh *remoteImageMounterHelper) resolveDigest(ctx context.Context, imageName string, cfg *kmmv1beta1.ModuleConfig) (string, error) {
+	digest, err := crane.Digest(imageName, rimh.craneOptions(ctx, cfg)...)
+	if err != nil {
+		return "", fmt.Errorf("could not get the digest for %s: %v", imageName, err)
+	}
+
+	return digest, nil
+}
+
+func (rimh *remoteImageMounterHelper) mountImage(ctx context.Context, imageName string, cfg *kmmv1beta1.ModuleConfig, expectedDigest string) (string, error) {
+	logger := rimh.logger.V(1).WithValues("image name", imageName)
+
+	opts := rimh.craneOptions(ctx, cfg)
+
 	logger.V(1).Info("Getting digest")
 
 	remoteDigest, err := crane.Digest(imageName, opts...)
@@ -96,49 +304,35 @@ func (rimh *remoteImageMounterHelper) mountImage(ctx context.Context, imageName
 		return "", fmt.Errorf("could not get the digest for %s: %v", imageName, err)
 	}
 
-	dstDir := filepath.Join(rimh.baseDir, imageName)
-	digestPath := filepath.Join(dstDir, "digest")
+	if expectedDigest != "" && remoteDigest != expectedDigest {
+		return "", fmt.Errorf(
+			"digest %s for %s does not match the digest %s pinned from the primary source; refusing to trust this mirror",
+			remoteDigest, imageName, expectedDigest,
+		)
+	}
 
+	// dstDir now lives under "baseDir/images/<imageName>", alongside the
+	// "baseDir/blobs/sha256/<digest>" layer cache; the returned fs
+	// subdirectory keeps MountImage's existing return-value contract, so
+	// callers of MountImage are unaffected by the move to a shared,
+	// content-addressable layer cache.
+	dstDir := filepath.Join(rimh.baseDir, "images", imageName)
+	digestPath := filepath.Join(dstDir, "digest")
 	dstDirFS := filepath.Join(dstDir, "fs")
-	cleanup := false
 
 	logger.Info("Reading digest file", "path", digestPath)
 
-	b, err := os.ReadFile(digestPath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			cleanup = true
-		} else {
-			return "", fmt.Errorf("could not open the digest file %s: %v", digestPath, err)
-		}
-	} else {
-		logger.V(1).Info(
-			"Comparing digests",
-			"local file",
-			string(b),
-			"remote image",
-			remoteDigest,
-		)
+	if b, err := os.ReadFile(digestPath); err == nil {
+		logger.V(1).Info("Comparing digests", "local file", string(b), "remote image", remoteDigest)
 
 		if string(b) == remoteDigest {
 			logger.Info("Local file and remote digest are identical; skipping pull")
 			return dstDirFS, nil
-		} else {
-			logger.Info("Local file and remote digest differ; pulling image")
-			cleanup = true
-		}
-	}
-
-	if cleanup {
-		logger.Info("Cleaning up image directory", "path", dstDir)
-
-		if err = os.RemoveAll(dstDir); err != nil {
-			return "", fmt.Errorf("could not cleanup %s: %v", dstDir, err)
 		}
-	}
 
-	if err = os.MkdirAll(dstDirFS, os.ModeDir|0755); err != nil {
-		return "", fmt.Errorf("could not create the filesystem directory %s: %v", dstDirFS, err)
+		logger.Info("Local file and remote digest differ; pulling image")
+	} else if !os.IsNotExist(err) {
+		return "", fmt.Errorf("could not open the digest file %s: %v", digestPath, err)
 	}
 
 	logger.V(1).Info("Pulling image")
@@ -148,74 +342,67 @@ func (rimh *remoteImageMounterHelper) mountImage(ctx context.Context, imageName
 		return "", fmt.Errorf("could not pull %s: %v", imageName, err)
 	}
 
-	errs := make(chan error, 2)
-
-	wg := sync.WaitGroup{}
-	wg.Add(2)
-
-	rd, wr := io.Pipe()
-
-	go func() {
-		defer wg.Done()
-		defer wr.Close()
-
-		logger.V(1).Info("Starting to export image")
+	layers, err := img.Layers()
+	if err != nil {
+		return "", fmt.Errorf("could not get the layers of %s: %v", imageName, err)
+	}
 
-		if err := crane.Export(img, wr); err != nil {
-			errs <- err
-			return
+	layerDirs := make([]string, 0, len(layers))
+	layerDigests := make([]string, 0, len(layers))
+
+	// Pin every layer digest before extracting it, and hold the pin until
+	// recordManifestLayers below has made the manifest-to-layer mapping
+	// durable. This keeps a concurrently running gc from reclaiming a
+	// layer that has just been extracted but is not yet referenced by any
+	// recorded manifest.
+	var unpins []func()
+	defer func() {
+		for _, unpin := range unpins {
+			unpin()
 		}
-
-		logger.V(1).Info("Done exporting image")
 	}()
 
-	go func() {
-		defer wg.Done()
-		defer rd.Close()
-
-		id := idtools.CurrentIdentity()
-
-		tarOpts := &archive.TarOptions{ChownOpts: &id}
-
-		if err := archive.Untar(rd, dstDirFS, tarOpts); err != nil {
-			errs <- err
-			return
+	for _, layer := range layers {
+		layerDigest, err := layer.Digest()
+		if err != nil {
+			return "", fmt.Errorf("could not get the digest of a layer of %s: %v", imageName, err)
 		}
 
-		logger.V(1).Info("Done writing tar archive")
-	}()
+		unpins = append(unpins, rimh.blobStore.pin(layerDigest.String()))
 
-	wg.Wait()
-	close(errs)
-
-	chErrs := make([]error, 0)
+		blobDir, err := rimh.blobStore.ensureLayer(layer)
+		if err != nil {
+			return "", fmt.Errorf("could not cache a layer of %s: %v", imageName, err)
+		}
+		layerDirs = append(layerDirs, blobDir)
+		layerDigests = append(layerDigests, layerDigest.String())
+	}
 
-	for chErr := range errs {
-		chErrs = append(chErrs, chErr)
+	if err = ctx.Err(); err != nil {
+		return "", fmt.Errorf("not assembling image root: %v", err)
 	}
 
-	if err = errors.Join(chErrs...); err != nil {
-		return "", fmt.Errorf("got one or more errors while writing the image: %v", err)
+	logger.Info("Cleaning up image directory", "path", dstDirFS)
+
+	if err = os.RemoveAll(dstDirFS); err != nil {
+		return "", fmt.Errorf("could not cleanup %s: %v", dstDirFS, err)
 	}
 
-	if err = ctx.Err(); err != nil {
-		return "", fmt.Errorf("not writing digest file: %v", err)
+	if err = rimh.blobStore.assembleRoot(dstDirFS, layerDirs); err != nil {
+		return "", fmt.Errorf("could not assemble the image root for %s: %v", imageName, err)
 	}
 
-	logger.V(1).Info("Image written to the filesystem")
+	logger.V(1).Info("Image assembled from cached layers")
 
-	digest, err := img.Digest()
-	if err != nil {
-		return "", fmt.Errorf("could not get the digest of the pulled image: %v", err)
+	if err = rimh.blobStore.recordManifestLayers(remoteDigest, layerDigests); err != nil {
+		logger.Error(err, "Could not record the manifest-to-layer mapping used for garbage collection")
 	}
 
-	digestStr := digest.String()
-
-	logger.V(1).Info("Writing digest", "digest", digestStr)
+	logger.V(1).Info("Writing digest", "digest", remoteDigest)
 
-	if err = os.WriteFile(digestPath, []byte(digestStr), 0644); err != nil {
+	if err = os.WriteFile(digestPath, []byte(remoteDigest), 0644); err != nil {
 		return "", fmt.Errorf("could not write the digest file at %s: %v", digestPath, err)
 	}
 
 	return dstDirFS, nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,285 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/go-logr/logr"
+	kmmv1beta1 "github.com/rh-ecosystem-edge/kernel-module-management/api/v1beta1"
+)
+
+func TestMirrorPullPolicyAllows(t *testing.T) {
+	cases := []struct {
+		policy    MirrorPullPolicy
+		digestRef bool
+		want      bool
+	}{
+		{MirrorPullPolicyAll, true, true},
+		{MirrorPullPolicyAll, false, true},
+		{MirrorPullPolicyDigestOnly, true, true},
+		{MirrorPullPolicyDigestOnly, false, false},
+		{MirrorPullPolicyTagOnly, true, false},
+		{MirrorPullPolicyTagOnly, false, true},
+	}
+
+	for _, c := range cases {
+		if got := c.policy.allows(c.digestRef); got != c.want {
+			t.Errorf("%s.allows(%v) = %v, want %v", c.policy, c.digestRef, got, c.want)
+		}
+	}
+}
+
+func TestIsDigestReference(t *testing.T) {
+	cases := []struct {
+		imageName string
+		want      bool
+	}{
+		{"example.com/repo:latest", false},
+		{"example.com/repo@sha256:" + fakeDigestHex, true},
+		{"not a valid reference!!", false},
+	}
+
+	for _, c := range cases {
+		if got := isDigestReference(c.imageName); got != c.want {
+			t.Errorf("isDigestReference(%q) = %v, want %v", c.imageName, got, c.want)
+		}
+	}
+}
+
+func TestRewriteRegistryHost(t *testing.T) {
+	cases := []struct {
+		name      string
+		imageName string
+		registry  string
+		want      string
+	}{
+		{"tag", "example.com/repo:v1", "mirror.example.com", "mirror.example.com/repo:v1"},
+		{"digest", "example.com/repo@sha256:" + fakeDigestHex, "mirror.example.com", "mirror.example.com/repo@sha256:" + fakeDigestHex},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := rewriteRegistryHost(c.imageName, c.registry)
+			if err != nil {
+				t.Fatalf("rewriteRegistryHost returned an error: %v", err)
+			}
+			if got != c.want {
+				t.Errorf("rewriteRegistryHost(%q, %q) = %q, want %q", c.imageName, c.registry, got, c.want)
+			}
+		})
+	}
+}
+
+const fakeDigestHex = "0000000000000000000000000000000000000000000000000000000000000000"
+
+// fakeMirrorResolver returns a canned MirrorSet for every image name.
+type fakeMirrorResolver struct {
+	set MirrorSet
+}
+
+func (f *fakeMirrorResolver) GetMirrorSet(imageName string) (MirrorSet, error) {
+	return f.set, nil
+}
+
+// fakeMounterHelper simulates pulling/mounting by reference name: a
+// reference either resolves to a canned digest or fails outright,
+// mirroring a registry that is down or refuses the request.
+type fakeMounterHelper struct {
+	digests  map[string]string // reference -> resolved digest
+	mounted  []string          // references mountImage was actually asked to pull
+	resolved []string          // references resolveDigest was asked to resolve
+}
+
+func (f *fakeMounterHelper) resolveDigest(_ context.Context, imageName string, _ *kmmv1beta1.ModuleConfig) (string, error) {
+	f.resolved = append(f.resolved, imageName)
+
+	digest, ok := f.digests[imageName]
+	if !ok {
+		return "", errors.New("could not reach registry")
+	}
+	return digest, nil
+}
+
+func (f *fakeMounterHelper) mountImage(_ context.Context, imageName string, _ *kmmv1beta1.ModuleConfig, expectedDigest string) (string, error) {
+	f.mounted = append(f.mounted, imageName)
+
+	digest, ok := f.digests[imageName]
+	if !ok {
+		return "", errors.New("could not reach registry")
+	}
+
+	if expectedDigest != "" && digest != expectedDigest {
+		return "", errors.New("digest mismatch")
+	}
+
+	return "/fs/" + imageName, nil
+}
+
+func TestMountImage_TagReferenceFallsBackThroughMirrors(t *testing.T) {
+	res := &fakeMirrorResolver{set: MirrorSet{
+		Primary: "primary.example.com/repo:v1",
+		Mirrors: []MirrorReference{
+			{Reference: "down.example.com/repo:v1", Policy: MirrorPullPolicyAll},
+			{Reference: "mirror.example.com/repo:v1", Policy: MirrorPullPolicyAll},
+		},
+	}}
+
+	helper := &fakeMounterHelper{digests: map[string]string{
+		"primary.example.com/repo:v1": "sha256:deadbeef",
+		"mirror.example.com/repo:v1":  "sha256:deadbeef",
+		// down.example.com is deliberately absent from digests, so
+		// mountImage fails for it and the loop must fall through.
+	}}
+
+	rim := &remoteImageMounter{res: res, helper: helper, logger: logr.Discard()}
+
+	fsDir, err := rim.MountImage(context.Background(), "primary.example.com/repo:v1", &kmmv1beta1.ModuleConfig{})
+	if err != nil {
+		t.Fatalf("MountImage returned an error: %v", err)
+	}
+
+	if want := "/fs/mirror.example.com/repo:v1"; fsDir != want {
+		t.Errorf("MountImage returned %q, want %q", fsDir, want)
+	}
+}
+
+func TestMountImage_DigestOnlyMirrorSkippedForTagReference(t *testing.T) {
+	res := &fakeMirrorResolver{set: MirrorSet{
+		Primary: "primary.example.com/repo:v1",
+		Mirrors: []MirrorReference{
+			{Reference: "digest-only.example.com/repo:v1", Policy: MirrorPullPolicyDigestOnly},
+			{Reference: "mirror.example.com/repo:v1", Policy: MirrorPullPolicyAll},
+		},
+	}}
+
+	helper := &fakeMounterHelper{digests: map[string]string{
+		"primary.example.com/repo:v1":     "sha256:deadbeef",
+		"digest-only.example.com/repo:v1": "sha256:deadbeef",
+		"mirror.example.com/repo:v1":      "sha256:deadbeef",
+	}}
+
+	rim := &remoteImageMounter{res: res, helper: helper, logger: logr.Discard()}
+
+	fsDir, err := rim.MountImage(context.Background(), "primary.example.com/repo:v1", &kmmv1beta1.ModuleConfig{})
+	if err != nil {
+		t.Fatalf("MountImage returned an error: %v", err)
+	}
+
+	if want := "/fs/mirror.example.com/repo:v1"; fsDir != want {
+		t.Errorf("MountImage returned %q, want %q", fsDir, want)
+	}
+
+	for _, m := range helper.mounted {
+		if m == "digest-only.example.com/repo:v1" {
+			t.Errorf("mountImage was asked to pull %q, a mirror that is digest-only for a tag reference", m)
+		}
+	}
+}
+
+func TestMountImage_DigestReferenceSkipsPinning(t *testing.T) {
+	imageName := "primary.example.com/repo@sha256:" + fakeDigestHex
+
+	res := &fakeMirrorResolver{set: MirrorSet{
+		Primary: imageName,
+		Mirrors: []MirrorReference{
+			{Reference: "mirror.example.com/repo@sha256:" + fakeDigestHex, Policy: MirrorPullPolicyAll},
+		},
+	}}
+
+	helper := &fakeMounterHelper{digests: map[string]string{
+		imageName: "sha256:" + fakeDigestHex,
+		"mirror.example.com/repo@sha256:" + fakeDigestHex: "sha256:" + fakeDigestHex,
+	}}
+
+	rim := &remoteImageMounter{res: res, helper: helper, logger: logr.Discard()}
+
+	if _, err := rim.MountImage(context.Background(), imageName, &kmmv1beta1.ModuleConfig{}); err != nil {
+		t.Fatalf("MountImage returned an error: %v", err)
+	}
+
+	// A digest reference is already a trusted pin; resolveDigest must not
+	// be consulted.
+	if len(helper.resolved) != 0 {
+		t.Errorf("resolveDigest was called for %v, want no calls for a digest reference", helper.resolved)
+	}
+	if len(helper.mounted) == 0 {
+		t.Fatal("expected mountImage to be called")
+	}
+}
+
+func TestMountImage_FailsClosedWhenPrimaryDigestCannotBeResolved(t *testing.T) {
+	res := &fakeMirrorResolver{set: MirrorSet{
+		Primary: "primary.example.com/repo:v1",
+		Mirrors: []MirrorReference{
+			{Reference: "mirror.example.com/repo:v1", Policy: MirrorPullPolicyAll},
+		},
+	}}
+
+	// No digests configured at all: resolveDigest against the primary
+	// fails, so mirrors must never be tried.
+	helper := &fakeMounterHelper{digests: map[string]string{}}
+
+	rim := &remoteImageMounter{res: res, helper: helper, logger: logr.Discard()}
+
+	_, err := rim.MountImage(context.Background(), "primary.example.com/repo:v1", &kmmv1beta1.ModuleConfig{})
+	if err == nil {
+		t.Fatal("expected MountImage to fail closed, got nil error")
+	}
+
+	for _, m := range helper.mounted {
+		if m == "mirror.example.com/repo:v1" {
+			t.Errorf("mountImage was asked to pull a mirror %q after the primary digest could not be pinned", m)
+		}
+	}
+}
+
+func TestMountImage_FallsBackToPrimaryWhenAllMirrorsAndUnqualifiedSearchFail(t *testing.T) {
+	res := &fakeMirrorResolver{set: MirrorSet{
+		Primary: "primary.example.com/repo:v1",
+		Mirrors: []MirrorReference{
+			{Reference: "down.example.com/repo:v1", Policy: MirrorPullPolicyAll},
+		},
+		UnqualifiedSearch: []string{"also-down.example.com"},
+	}}
+
+	helper := &fakeMounterHelper{digests: map[string]string{
+		"primary.example.com/repo:v1": "sha256:deadbeef",
+		// down.example.com and also-down.example.com are deliberately
+		// absent from digests, so both the mirror and the
+		// unqualified-search candidate fail and MountImage must fall
+		// back to pulling the primary source itself.
+	}}
+
+	rim := &remoteImageMounter{res: res, helper: helper, logger: logr.Discard()}
+
+	fsDir, err := rim.MountImage(context.Background(), "primary.example.com/repo:v1", &kmmv1beta1.ModuleConfig{})
+	if err != nil {
+		t.Fatalf("MountImage returned an error: %v", err)
+	}
+
+	if want := "/fs/primary.example.com/repo:v1"; fsDir != want {
+		t.Errorf("MountImage returned %q, want %q", fsDir, want)
+	}
+}
+
+func TestMountImage_DefaultsToPrimaryWhenNoMirrorsConfigured(t *testing.T) {
+	res := &fakeMirrorResolver{set: MirrorSet{
+		Primary: "primary.example.com/repo:v1",
+	}}
+
+	helper := &fakeMounterHelper{digests: map[string]string{
+		"primary.example.com/repo:v1": "sha256:deadbeef",
+	}}
+
+	rim := &remoteImageMounter{res: res, helper: helper, logger: logr.Discard()}
+
+	fsDir, err := rim.MountImage(context.Background(), "primary.example.com/repo:v1", &kmmv1beta1.ModuleConfig{})
+	if err != nil {
+		t.Fatalf("MountImage returned an error: %v", err)
+	}
+
+	if want := "/fs/primary.example.com/repo:v1"; fsDir != want {
+		t.Errorf("MountImage returned %q, want %q", fsDir, want)
+	}
+}